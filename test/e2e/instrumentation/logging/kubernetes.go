@@ -0,0 +1,227 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	api_v1 "k8s.io/api/core/v1"
+	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/kubernetes/test/e2e/framework"
+)
+
+// kubernetesLogsProvider retrieves log entries directly from the kubelet via
+// the pod log API, rather than through an external backend such as
+// Stackdriver or Elasticsearch. Because it reads straight from the source
+// the kubelet is streaming from, it is used as a provider-independent
+// baseline to tell apart logs that never left the node from logs that were
+// lost somewhere in the aggregation pipeline.
+type kubernetesLogsProvider struct {
+	framework *framework.Framework
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	states map[string]*podLogState
+}
+
+// podLogState caches the log lines streamed for a single pod that have not
+// yet been returned to the caller. ReadEntries empties the cache, so that it
+// only reports new lines.
+type podLogState struct {
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func newKubernetesLogsProvider(f *framework.Framework) logsProvider {
+	return &kubernetesLogsProvider{
+		framework: f,
+	}
+}
+
+func (p *kubernetesLogsProvider) Init() error {
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	p.states = make(map[string]*podLogState)
+	return nil
+}
+
+func (p *kubernetesLogsProvider) Cleanup() {
+	if p.cancel != nil {
+		p.cancel()
+	}
+	p.wg.Wait()
+}
+
+func (p *kubernetesLogsProvider) ReadEntries(pod *loggingPod) []logEntry {
+	state := p.streamFor(pod)
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	entries := state.entries
+	state.entries = nil
+	return entries
+}
+
+func (p *kubernetesLogsProvider) FluentdApplicationName() string {
+	return ""
+}
+
+// streamFor returns the podLogState for pod, starting the goroutine that
+// streams its logs from the kubelet the first time it is requested.
+func (p *kubernetesLogsProvider) streamFor(pod *loggingPod) *podLogState {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if state, ok := p.states[pod.Name]; ok {
+		return state
+	}
+
+	state := &podLogState{}
+	p.states[pod.Name] = state
+
+	p.wg.Add(1)
+	go p.streamPodLogs(pod, state)
+
+	return state
+}
+
+// streamPodLogs continuously streams the logs of pod from the kubelet and
+// appends each line it reads to state. If the stream is interrupted, it is
+// reopened with SinceTime anchored on the klog emission timestamp of the
+// last line read (not the reader's wall clock, which can be skewed from the
+// node's), so that the whole log is not re-read from the beginning. The
+// kubelet can still replay lines at or after that timestamp on reconnect;
+// consume() drops anything up to and including the last line number
+// already recorded so those replays aren't double-counted.
+func (p *kubernetesLogsProvider) streamPodLogs(pod *loggingPod, state *podLogState) {
+	defer p.wg.Done()
+
+	var sinceTime *meta_v1.Time
+	lastLineNumber := -1
+	haveLastLineNumber := false
+
+	for {
+		select {
+		case <-p.ctx.Done():
+			return
+		default:
+		}
+
+		opts := &api_v1.PodLogOptions{
+			Container: loggingContainerName,
+			Follow:    true,
+			SinceTime: sinceTime,
+		}
+
+		stream, err := p.framework.ClientSet.Core().Pods(p.framework.Namespace.Name).GetLogs(pod.Name, opts).Stream()
+		if err != nil {
+			framework.Logf("Failed to open log stream for pod %s: %v", pod.Name, err)
+			if !p.sleepOrDone(ingestionRetryDelay) {
+				return
+			}
+			continue
+		}
+
+		// Stream() has no context of its own, so a goroutine closes it
+		// on cancellation to unblock consume()'s Scan() call.
+		streamDone := make(chan struct{})
+		go func() {
+			select {
+			case <-p.ctx.Done():
+				stream.Close()
+			case <-streamDone:
+			}
+		}()
+
+		lastEmitted, newLastLineNumber, sawLineNumber := p.consume(stream, state, lastLineNumber, haveLastLineNumber)
+		close(streamDone)
+		stream.Close()
+
+		if sawLineNumber {
+			lastLineNumber = newLastLineNumber
+			haveLastLineNumber = true
+		}
+		if !lastEmitted.IsZero() {
+			t := meta_v1.NewTime(emissionTimeNear(lastEmitted, time.Now()))
+			sinceTime = &t
+		}
+
+		if !p.sleepOrDone(ingestionRetryDelay) {
+			return
+		}
+	}
+}
+
+// consume reads newline-delimited log entries from r until it is closed or
+// the provider is cleaned up, appending each one to state. A line whose
+// parsed line number is less than or equal to skipLineNumber is assumed to
+// be a kubelet replay of something already recorded before the previous
+// reconnect and is dropped instead of being appended again; haveSkipLineNumber
+// is false on the very first connection, when nothing has been recorded yet.
+// Lines without a parseable line number are never skipped, so a missing
+// anchor can't wedge the skip state for the rest of the connection. consume
+// returns the klog emission timestamp and line number of the last line read
+// that had one.
+func (p *kubernetesLogsProvider) consume(r io.ReadCloser, state *podLogState, skipLineNumber int, haveSkipLineNumber bool) (lastEmitted time.Time, lastLineNumber int, haveLastLineNumber bool) {
+	scanner := bufio.NewScanner(r)
+
+	for scanner.Scan() {
+		select {
+		case <-p.ctx.Done():
+			return lastEmitted, lastLineNumber, haveLastLineNumber
+		default:
+		}
+
+		entry := logEntry{Payload: scanner.Text(), IngestionTimestamp: time.Now()}
+
+		if lineNumber, ok := entry.getLogEntryNumber(); ok {
+			if haveSkipLineNumber && lineNumber <= skipLineNumber {
+				continue
+			}
+			lastLineNumber = lineNumber
+			haveLastLineNumber = true
+		}
+
+		if emitted, ok := entry.getLogEntryTimestamp(); ok {
+			lastEmitted = emitted
+		}
+
+		state.mu.Lock()
+		state.entries = append(state.entries, entry)
+		state.mu.Unlock()
+	}
+
+	return lastEmitted, lastLineNumber, haveLastLineNumber
+}
+
+// sleepOrDone waits for d, returning false early if the provider is
+// cleaned up in the meantime.
+func (p *kubernetesLogsProvider) sleepOrDone(d time.Duration) bool {
+	select {
+	case <-p.ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
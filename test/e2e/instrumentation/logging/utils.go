@@ -17,11 +17,16 @@ limitations under the License.
 package logging
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"regexp"
+	"sort"
 	"strconv"
 	"time"
 
+	"golang.org/x/sync/errgroup"
+
 	api_v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/resource"
 	meta_v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -43,27 +48,57 @@ const (
 
 	// Name of the container used for logging tests
 	loggingContainerName = "logging-container"
+
+	// Default number of pods that may be read from concurrently, used
+	// when loggingTestConfig.MaxReadParallelism is left unset.
+	defaultReadParallelism = 10
+
+	// Number of largest missing-line gaps logged per pod in
+	// waitForFullLogsIngestion.
+	topGapsToLog = 3
 )
 
 var (
-	// Regexp, matching the contents of log entries, parsed or not
-	logEntryMessageRegex = regexp.MustCompile("(?:I\\d+ \\d+:\\d+:\\d+.\\d+       \\d+ logs_generator.go:67] )?(\\d+) .*")
+	// Regexp, matching the contents of log entries, parsed or not. The
+	// first submatch captures the klog emission timestamp (month, day,
+	// time of day and microseconds), the second the line number.
+	logEntryMessageRegex = regexp.MustCompile("(?:I(\\d{4} \\d{2}:\\d{2}:\\d{2}\\.\\d{6})       \\d+ logs_generator.go:67] )?(\\d+) .*")
+
+	// Layout matching the timestamp captured by logEntryMessageRegex, as
+	// understood by time.Parse. klog timestamps don't carry a year.
+	logEntryTimestampLayout = "0102 15:04:05.000000"
 )
 
 type logEntry struct {
 	Payload string
+	// IngestionTimestamp is when the entry was observed by the
+	// logsProvider, e.g. the backend's insert time or the time the
+	// kubelet streamed it. Left zero if the provider doesn't know it.
+	IngestionTimestamp time.Time
 }
 
 func (entry logEntry) getLogEntryNumber() (int, bool) {
 	submatch := logEntryMessageRegex.FindStringSubmatch(entry.Payload)
-	if submatch == nil || len(submatch) < 2 {
+	if submatch == nil || len(submatch) < 3 {
 		return 0, false
 	}
 
-	lineNumber, err := strconv.Atoi(submatch[1])
+	lineNumber, err := strconv.Atoi(submatch[2])
 	return lineNumber, err == nil
 }
 
+// getLogEntryTimestamp returns the time at which entry was emitted by the
+// logs-generator container, parsed out of its klog prefix.
+func (entry logEntry) getLogEntryTimestamp() (time.Time, bool) {
+	submatch := logEntryMessageRegex.FindStringSubmatch(entry.Payload)
+	if submatch == nil || len(submatch) < 2 || submatch[1] == "" {
+		return time.Time{}, false
+	}
+
+	timestamp, err := time.Parse(logEntryTimestampLayout, submatch[1])
+	return timestamp, err == nil
+}
+
 type logsProvider interface {
 	Init() error
 	Cleanup()
@@ -77,6 +112,31 @@ type loggingTestConfig struct {
 	IngestionTimeout          time.Duration
 	MaxAllowedLostFraction    float64
 	MaxAllowedFluentdRestarts int
+	// MaxReadParallelism bounds how many pods may be read from via
+	// LogsProvider.ReadEntries concurrently. Defaults to
+	// defaultReadParallelism when left at zero.
+	MaxReadParallelism int
+	// MaxAllowedP99Latency is the maximum tolerated p99 end-to-end
+	// ingestion latency (emission to ingestion) per pod. Zero means no
+	// latency SLO is enforced.
+	MaxAllowedP99Latency time.Duration
+	// MaxAllowedContiguousGap bounds the longest allowed run of missing
+	// line numbers for any one pod. Zero means no such limit is enforced.
+	MaxAllowedContiguousGap int
+	// MaxAllowedDuplicateFraction bounds a pod's number of repeated
+	// deliveries (every delivery of a line beyond its first, summed over
+	// all lines) as a fraction of its expected lines. Zero means no such
+	// limit is enforced.
+	MaxAllowedDuplicateFraction float64
+}
+
+// readParallelism returns the configured read parallelism, or
+// defaultReadParallelism if none was set.
+func (config *loggingTestConfig) readParallelism() int {
+	if config.MaxReadParallelism <= 0 {
+		return defaultReadParallelism
+	}
+	return config.MaxReadParallelism
 }
 
 // Type to track the progress of logs generating pod
@@ -86,8 +146,10 @@ type loggingPod struct {
 	// NodeName is the name of the node this pod will be
 	// assigned to. Can be empty.
 	NodeName string
-	// Occurrences is a cache of ingested and read entries.
-	Occurrences map[int]logEntry
+	// Occurrences is a cache of ingested and read entries, keyed by line
+	// number. A line number can map to more than one entry if it was
+	// delivered more than once.
+	Occurrences map[int][]logEntry
 	// ExpectedLinesNumber is the number of lines that are
 	// expected to be ingested from this pod.
 	ExpectedLinesNumber int
@@ -99,7 +161,7 @@ func newLoggingPod(podName string, nodeName string, totalLines int, loggingDurat
 	return &loggingPod{
 		Name:                podName,
 		NodeName:            nodeName,
-		Occurrences:         make(map[int]logEntry),
+		Occurrences:         make(map[int][]logEntry),
 		ExpectedLinesNumber: totalLines,
 		RunDuration:         loggingDuration,
 	}
@@ -150,17 +212,51 @@ func startNewLoggingPod(f *framework.Framework, podName string, nodeName string,
 	return pod
 }
 
+// readEntriesParallel reads from every pod in pods concurrently, bounded by
+// parallelism, and returns the entries read for pod i in result[i]. Callers
+// that only want entries for a subset of config.Pods must pass just that
+// subset: ReadEntries on some providers is destructive, so reading from a
+// pod whose result isn't consumed loses those entries for good.
+func readEntriesParallel(provider logsProvider, parallelism int, pods []*loggingPod) [][]logEntry {
+	entries := make([][]logEntry, len(pods))
+
+	g, _ := errgroup.WithContext(context.Background())
+	sem := make(chan struct{}, parallelism)
+
+	for podIdx, pod := range pods {
+		podIdx, pod := podIdx, pod
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			entries[podIdx] = provider.ReadEntries(pod)
+			return nil
+		})
+	}
+
+	// ReadEntries doesn't return an error, so g.Wait() can't fail here.
+	g.Wait()
+	return entries
+}
+
 func waitForSomeLogs(f *framework.Framework, config *loggingTestConfig) error {
 	podHasIngestedLogs := make([]bool, len(config.Pods))
 	podWithIngestedLogsCount := 0
 
 	for start := time.Now(); time.Since(start) < config.IngestionTimeout; time.Sleep(ingestionRetryDelay) {
+		var pending []*loggingPod
+		var pendingIdx []int
 		for podIdx, pod := range config.Pods {
-			if podHasIngestedLogs[podIdx] {
-				continue
+			if !podHasIngestedLogs[podIdx] {
+				pending = append(pending, pod)
+				pendingIdx = append(pendingIdx, podIdx)
 			}
+		}
+
+		entriesByPending := readEntriesParallel(config.LogsProvider, config.readParallelism(), pending)
 
-			entries := config.LogsProvider.ReadEntries(pod)
+		for i, pod := range pending {
+			entries := entriesByPending[i]
 			if len(entries) == 0 {
 				framework.Logf("No log entries from pod %s", pod.Name)
 				continue
@@ -169,7 +265,7 @@ func waitForSomeLogs(f *framework.Framework, config *loggingTestConfig) error {
 			for _, entry := range entries {
 				if _, ok := entry.getLogEntryNumber(); ok {
 					framework.Logf("Found some log entries from pod %s", pod.Name)
-					podHasIngestedLogs[podIdx] = true
+					podHasIngestedLogs[pendingIdx[i]] = true
 					podWithIngestedLogsCount++
 					break
 				}
@@ -202,16 +298,24 @@ func waitForFullLogsIngestion(f *framework.Framework, config *loggingTestConfig)
 	}
 
 	for start := time.Now(); time.Since(start) < config.IngestionTimeout; time.Sleep(ingestionRetryDelay) {
-		missing := 0
+		var pending []*loggingPod
+		var pendingIdx []int
 		for podIdx, pod := range config.Pods {
-			if missingByPod[podIdx] == 0 {
-				continue
+			if missingByPod[podIdx] != 0 {
+				pending = append(pending, pod)
+				pendingIdx = append(pendingIdx, podIdx)
 			}
+		}
 
-			missingByPod[podIdx] = pullMissingLogsCount(config.LogsProvider, pod)
-			missing += missingByPod[podIdx]
+		entriesByPending := readEntriesParallel(config.LogsProvider, config.readParallelism(), pending)
+		for i, pod := range pending {
+			missingByPod[pendingIdx[i]] = getMissingLinesCount(pod, entriesByPending[i])
 		}
 
+		missing := 0
+		for _, count := range missingByPod {
+			missing += count
+		}
 		totalMissing = missing
 		if totalMissing > 0 {
 			framework.Logf("Still missing %d lines in total", totalMissing)
@@ -237,6 +341,31 @@ func waitForFullLogsIngestion(f *framework.Framework, config *loggingTestConfig)
 			lostFraction*100, config.MaxAllowedLostFraction*100)
 	}
 
+	for _, pod := range config.Pods {
+		report := analyzeOccurrences(pod)
+		logTopGaps(pod, report, topGapsToLog)
+
+		if report.OutOfOrderCount > 0 {
+			framework.Logf("Pod %s had %d out-of-order line arrivals", pod.Name, report.OutOfOrderCount)
+		}
+
+		if config.MaxAllowedContiguousGap > 0 && report.LongestContiguousGap > config.MaxAllowedContiguousGap {
+			return fmt.Errorf("longest contiguous gap for pod %s was %d lines, which is more than the allowed %d",
+				pod.Name, report.LongestContiguousGap, config.MaxAllowedContiguousGap)
+		}
+
+		totalDuplicates := 0
+		for _, dup := range report.DuplicateCounts {
+			totalDuplicates += dup
+		}
+		duplicateFraction := float64(totalDuplicates) / float64(pod.ExpectedLinesNumber)
+
+		if config.MaxAllowedDuplicateFraction > 0 && duplicateFraction > config.MaxAllowedDuplicateFraction {
+			return fmt.Errorf("duplicate fraction for pod %s was %.2f%%, which is more than the allowed %.2f%%",
+				pod.Name, duplicateFraction*100, config.MaxAllowedDuplicateFraction*100)
+		}
+	}
+
 	fluentdPods, err := getFluentdPods(f, config.LogsProvider.FluentdApplicationName())
 	if err != nil {
 		return fmt.Errorf("failed to get fluentd pods due to %v", err)
@@ -256,22 +385,189 @@ func waitForFullLogsIngestion(f *framework.Framework, config *loggingTestConfig)
 			maxRestartCount, config.MaxAllowedFluentdRestarts)
 	}
 
+	for _, pod := range config.Pods {
+		p50, p95, p99, ok := ingestionLatencyPercentiles(pod)
+		if !ok {
+			framework.Logf("No ingestion timestamps available for pod %s, skipping latency percentiles", pod.Name)
+			continue
+		}
+
+		framework.Logf("Ingestion latency for pod %s: p50=%v p95=%v p99=%v", pod.Name, p50, p95, p99)
+
+		if config.MaxAllowedP99Latency > 0 && p99 > config.MaxAllowedP99Latency {
+			return fmt.Errorf("p99 ingestion latency for pod %s was %v, which is more than allowed %v",
+				pod.Name, p99, config.MaxAllowedP99Latency)
+		}
+	}
+
 	return nil
 }
 
-func pullMissingLogsCount(logsProvider logsProvider, pod *loggingPod) int {
-	missingOnPod, err := getMissingLinesCount(logsProvider, pod)
-	if err != nil {
-		framework.Logf("Failed to get missing lines count from pod %s due to %v", pod.Name, err)
-		return pod.ExpectedLinesNumber
+// ingestionLatencyPercentiles returns the p50, p95 and p99 end-to-end
+// ingestion latency (time from emission by the logs-generator container to
+// ingestion by the logs provider) observed across pod.Occurrences. Entries
+// whose emission or ingestion timestamp can't be determined are ignored.
+// ok is false if no entry had both timestamps available, in which case the
+// percentiles are meaningless rather than zero latency.
+func ingestionLatencyPercentiles(pod *loggingPod) (p50, p95, p99 time.Duration, ok bool) {
+	var latencies []time.Duration
+
+	for _, occurrences := range pod.Occurrences {
+		for _, entry := range occurrences {
+			if entry.IngestionTimestamp.IsZero() {
+				continue
+			}
+
+			emitted, ok := entry.getLogEntryTimestamp()
+			if !ok {
+				continue
+			}
+			emitted = emissionTimeNear(emitted, entry.IngestionTimestamp)
+
+			latencies = append(latencies, entry.IngestionTimestamp.Sub(emitted))
+		}
+	}
+
+	if len(latencies) == 0 {
+		return 0, 0, 0, false
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	return latencyPercentile(latencies, 0.50), latencyPercentile(latencies, 0.95), latencyPercentile(latencies, 0.99), true
+}
+
+// emissionTimeNear returns the klog-parsed emitted timestamp (which carries
+// no year) with reference's year grafted onto it, correcting for the
+// turn-of-year wraparound where emission fell in December of the year
+// before reference.
+func emissionTimeNear(emitted, reference time.Time) time.Time {
+	withYear := emitted.AddDate(reference.Year(), 0, 0)
+	if withYear.After(reference) && withYear.Month() == time.December && reference.Month() == time.January {
+		withYear = withYear.AddDate(-1, 0, 0)
+	}
+	return withYear
+}
+
+// latencyPercentile returns the p-th percentile (0 < p <= 1) of sorted,
+// which must already be sorted in ascending order.
+func latencyPercentile(sorted []time.Duration, p float64) time.Duration {
+	idx := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// lineRange is an inclusive range of missing line numbers [Lo, Hi].
+type lineRange struct {
+	Lo, Hi int
+}
+
+// IngestionReport describes the shape of the lines missing from a pod's
+// Occurrences, rather than just how many are missing, so that regressions
+// like a single contiguous gap can be told apart from random loss.
+type IngestionReport struct {
+	// MissingRanges lists the contiguous runs of line numbers that were
+	// never ingested, in ascending order.
+	MissingRanges []lineRange
+	// LongestContiguousGap is the length in lines of the largest entry
+	// in MissingRanges, or zero if nothing is missing.
+	LongestContiguousGap int
+	// DuplicateCounts maps a line number to the number of times it was
+	// delivered beyond the first, for every line delivered more than once.
+	DuplicateCounts map[int]int
+	// OutOfOrderCount is the number of lines whose first delivery's
+	// IngestionTimestamp precedes that of the nearest earlier line number
+	// with a known timestamp. Lines without a known timestamp are skipped.
+	OutOfOrderCount int
+}
+
+// analyzeOccurrences walks pod.Occurrences in line-number order and reports
+// the missing ranges, the longest contiguous gap, per-line duplicate
+// delivery counts and out-of-order arrivals.
+func analyzeOccurrences(pod *loggingPod) IngestionReport {
+	report := IngestionReport{DuplicateCounts: make(map[int]int)}
+
+	gapStart := -1
+	var lastIngestionTime time.Time
+
+	closeGap := func(hi int) {
+		if gapStart == -1 {
+			return
+		}
+		report.MissingRanges = append(report.MissingRanges, lineRange{Lo: gapStart, Hi: hi})
+		if gap := hi - gapStart + 1; gap > report.LongestContiguousGap {
+			report.LongestContiguousGap = gap
+		}
+		gapStart = -1
 	}
 
-	return missingOnPod
+	for lineNumber := 0; lineNumber < pod.ExpectedLinesNumber; lineNumber++ {
+		occurrences := pod.Occurrences[lineNumber]
+		if len(occurrences) == 0 {
+			if gapStart == -1 {
+				gapStart = lineNumber
+			}
+			continue
+		}
+		closeGap(lineNumber - 1)
+
+		if dup := len(occurrences) - 1; dup > 0 {
+			report.DuplicateCounts[lineNumber] = dup
+		}
+
+		ingestionTime := occurrences[0].IngestionTimestamp
+		if !ingestionTime.IsZero() {
+			if !lastIngestionTime.IsZero() && ingestionTime.Before(lastIngestionTime) {
+				report.OutOfOrderCount++
+			}
+			lastIngestionTime = ingestionTime
+		}
+	}
+	closeGap(pod.ExpectedLinesNumber - 1)
+
+	return report
 }
 
-func getMissingLinesCount(logsProvider logsProvider, pod *loggingPod) (int, error) {
-	entries := logsProvider.ReadEntries(pod)
+// logTopGaps logs the n largest missing-line ranges in report, together
+// with the ingestion timestamps of the entries immediately surrounding each
+// gap when known, to help tell apart a Fluentd restart or buffer overflow
+// from random line loss.
+func logTopGaps(pod *loggingPod, report IngestionReport, n int) {
+	gaps := append([]lineRange(nil), report.MissingRanges...)
+	sort.Slice(gaps, func(i, j int) bool {
+		return (gaps[i].Hi - gaps[i].Lo) > (gaps[j].Hi - gaps[j].Lo)
+	})
+
+	if len(gaps) > n {
+		gaps = gaps[:n]
+	}
+
+	for _, gap := range gaps {
+		before := surroundingTimestamp(pod, gap.Lo-1)
+		after := surroundingTimestamp(pod, gap.Hi+1)
+		framework.Logf("Pod %s is missing lines [%d, %d] (%d lines), surrounded by ingestion timestamps %v and %v",
+			pod.Name, gap.Lo, gap.Hi, gap.Hi-gap.Lo+1, before, after)
+	}
+}
+
+// surroundingTimestamp returns the ingestion timestamp of the first
+// occurrence of lineNumber, or the zero time if it wasn't ingested.
+func surroundingTimestamp(pod *loggingPod, lineNumber int) time.Time {
+	occurrences := pod.Occurrences[lineNumber]
+	if len(occurrences) == 0 {
+		return time.Time{}
+	}
+	return occurrences[0].IngestionTimestamp
+}
 
+// getMissingLinesCount records entries into pod.Occurrences and returns how
+// many of pod.ExpectedLinesNumber lines are still missing.
+func getMissingLinesCount(pod *loggingPod, entries []logEntry) int {
 	for _, entry := range entries {
 		lineNumber, ok := entry.getLogEntryNumber()
 		if !ok {
@@ -281,11 +577,11 @@ func getMissingLinesCount(logsProvider logsProvider, pod *loggingPod) (int, erro
 		if lineNumber < 0 || lineNumber >= pod.ExpectedLinesNumber {
 			framework.Logf("Unexpected line number: %d", lineNumber)
 		} else {
-			pod.Occurrences[lineNumber] = entry
+			pod.Occurrences[lineNumber] = append(pod.Occurrences[lineNumber], entry)
 		}
 	}
 
-	return pod.ExpectedLinesNumber - len(pod.Occurrences), nil
+	return pod.ExpectedLinesNumber - len(pod.Occurrences)
 }
 
 func ensureSingleFluentdOnEachNode(f *framework.Framework, fluentdApplicationName string) error {
@@ -0,0 +1,62 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package logging
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIngestionLatencyPercentilesWithYearlessEmissionTimestamp(t *testing.T) {
+	ingested := time.Date(2026, time.July, 27, 12, 0, 0, 200000000, time.UTC)
+
+	pod := &loggingPod{
+		ExpectedLinesNumber: 1,
+		Occurrences: map[int][]logEntry{
+			0: {
+				{
+					Payload:            "I0727 12:00:00.000000       1 logs_generator.go:67] 0 foo",
+					IngestionTimestamp: ingested,
+				},
+			},
+		},
+	}
+
+	p50, p95, p99, ok := ingestionLatencyPercentiles(pod)
+	if !ok {
+		t.Fatalf("ingestionLatencyPercentiles returned ok=false, want true")
+	}
+
+	for name, latency := range map[string]time.Duration{"p50": p50, "p95": p95, "p99": p99} {
+		if latency <= 0 || latency > time.Second {
+			t.Errorf("%s = %v, want a small positive latency around 200ms, not an overflowed ~2000-year duration", name, latency)
+		}
+	}
+}
+
+func TestIngestionLatencyPercentilesWithNoTimestamps(t *testing.T) {
+	pod := &loggingPod{
+		ExpectedLinesNumber: 1,
+		Occurrences: map[int][]logEntry{
+			0: {{Payload: "some line with no klog prefix"}},
+		},
+	}
+
+	if _, _, _, ok := ingestionLatencyPercentiles(pod); ok {
+		t.Errorf("ingestionLatencyPercentiles returned ok=true with no usable timestamps, want false")
+	}
+}